@@ -0,0 +1,333 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+
+    tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestFormatText(t *testing.T) {
+    tests := []struct {
+        name, text, html, v2 string
+    }{
+        {"plain", "Tom & Jerry <3", "Tom &amp; Jerry &lt;3", "Tom & Jerry <3"},
+        {"bold", "*Дюна* (2021)", "<b>Дюна</b> (2021)", "*Дюна* \\(2021\\)"},
+        {"italic", "_скоро_", "<i>скоро</i>", "_скоро_"},
+        {"escaped markers", "\\_a\\_ \\*b\\* \\`c\\` \\[d]", "_a_ *b* `c` [d]", "\\_a\\_ \\*b\\* \\`c\\` \\[d\\]"},
+        {"nested", "*bold _italic_*", "<b>bold _italic_</b>", "*bold \\_italic\\_*"},
+        {"title with underscore", "*" + escapeMarkdown("Snake_Eyes") + "*", "<b>Snake_Eyes</b>", "*Snake\\_Eyes*"},
+        {"title with asterisks", "*" + escapeMarkdown("M*A*S*H") + "*", "<b>M*A*S*H</b>", "*M\\*A\\*S\\*H*"},
+        {"code", "`a<b_c.d`", "<code>a&lt;b_c.d</code>", "`a<b_c.d`"},
+        {"code keeps backslashes", "`a\\_b`", "<code>a\\_b</code>", "`a\\\\_b`"},
+        {"punctuation", "Spider-Man: No Way Home (2021).", "Spider-Man: No Way Home (2021).", "Spider\\-Man: No Way Home \\(2021\\)\\."},
+        {"unbalanced", "*open", "*open", "\\*open"},
+        {"unbalanced with escapes", "*a \\_b", "*a _b", "\\*a \\_b"},
+        // A result caption is formatted once, whether it goes out with its
+        // poster or as the text fallback of a failed photo
+        {"poster caption", "1. *Tom & Jerry: Mouse\\_Trap* (фильм, 1992-10-01) - Cat <3 mouse.",
+            "1. <b>Tom &amp; Jerry: Mouse_Trap</b> (фильм, 1992-10-01) - Cat &lt;3 mouse.",
+            "1\\. *Tom & Jerry: Mouse\\_Trap* \\(фильм, 1992\\-10\\-01\\) \\- Cat <3 mouse\\."},
+    }
+    for _, tt := range tests {
+        if got := formatText(tt.text, tgbotapi.ModeHTML); got != tt.html {
+            t.Errorf("%s: formatText(%q, HTML) = %q, want %q", tt.name, tt.text, got, tt.html)
+        }
+        if got := formatText(tt.text, tgbotapi.ModeMarkdownV2); got != tt.v2 {
+            t.Errorf("%s: formatText(%q, MarkdownV2) = %q, want %q", tt.name, tt.text, got, tt.v2)
+        }
+        if got := formatText(tt.text, tgbotapi.ModeMarkdown); got != tt.text {
+            t.Errorf("%s: formatText(%q, Markdown) = %q, want it unchanged", tt.name, tt.text, got)
+        }
+    }
+}
+
+// openTestDB points db at a new database in a temporary directory, with all
+// migrations applied
+func openTestDB(t *testing.T) {
+    t.Helper()
+    var err error
+    db, err = openStore("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    log.SetOutput(io.Discard)
+    t.Cleanup(func() {
+        log.SetOutput(os.Stderr)
+        db.Close()
+    })
+    if err := createTables(db); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// addTestEntries stores entries with the given titles for user 1
+func addTestEntries(t *testing.T, titles ...string) {
+    t.Helper()
+    for i, title := range titles {
+        if _, err := db.Exec("INSERT INTO watched (title, media_type, tmdb_id, user_id, watched_at) VALUES (?, 'tv', ?, 1, ?)", title, i+1, time.Now()); err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestParseSeasonEpisode(t *testing.T) {
+    tests := []struct {
+        text            string
+        season, episode int
+        ok              bool
+    }{
+        {"8", 0, 8, true},
+        {" 12 ", 0, 12, true},
+        {"0", 0, 0, true},
+        {"S2 8", 2, 8, true},
+        {"s2e8", 2, 8, true},
+        {"S10E1", 10, 1, true},
+        {"С2 8", 2, 8, true}, // Cyrillic С
+        {"S2 0", 0, 0, false},
+        {"S2", 0, 0, false},
+        {"-1", 0, 0, false},
+        {"пятая", 0, 0, false},
+        {"", 0, 0, false},
+    }
+    for _, tt := range tests {
+        season, episode, ok := parseSeasonEpisode(tt.text)
+        if ok != tt.ok || (ok && (season != tt.season || episode != tt.episode)) {
+            t.Errorf("parseSeasonEpisode(%q) = %d, %d, %v, want %d, %d, %v", tt.text, season, episode, ok, tt.season, tt.episode, tt.ok)
+        }
+    }
+}
+
+func TestSplitTitleArg(t *testing.T) {
+    openTestDB(t)
+    addTestEntries(t, "Lost", "Area 51", "Area 51 2011", "1917", "Во все тяжкие")
+
+    tests := []struct {
+        query, title, arg string
+        ok                bool
+    }{
+        {"Lost 5", "Lost", "5", true},
+        {"lost S2 8", "Lost", "S2 8", true},
+        {"Area 51 5", "Area 51", "5", true},
+        {"Area 51", "Area 51", "", true},
+        {"Area 51 2011 5", "Area 51 2011", "5", true},
+        {"Area 51 2011", "Area 51 2011", "", true},
+        {"1917 3", "1917", "3", true},
+        {"во все тяжкие 10", "Во все тяжкие", "10", true},
+        {"Area 51 | 2011", "Area 51", "2011", true},
+        {"Los | 4", "Lost", "4", true},
+        {"Unknown 5", "", "", false},
+    }
+    for _, tt := range tests {
+        entry, arg, err := splitTitleArg(1, tt.query)
+        if (err == nil) != tt.ok || (tt.ok && (entry.Title != tt.title || arg != tt.arg)) {
+            t.Errorf("splitTitleArg(%q) = %q, %q, %v, want %q, %q", tt.query, entry.Title, arg, err, tt.title, tt.arg)
+        }
+    }
+}
+
+// importTestEntries returns n distinct entries for importEntries
+func importTestEntries(n int) []exportEntry {
+    entries := make([]exportEntry, n)
+    for i := range entries {
+        entries[i] = exportEntry{Title: "Фильм " + strconv.Itoa(i+1), MediaType: "movie", TMDBID: i + 1, Rating: i % 11}
+    }
+    return entries
+}
+
+func TestImportEntriesPartialBatch(t *testing.T) {
+    for _, n := range []int{1, importBatchSize - 1, importBatchSize, importBatchSize + 1, 2*importBatchSize + 3} {
+        openTestDB(t)
+        count, err := importEntries(1, importTestEntries(n))
+        if err != nil {
+            t.Fatalf("importEntries(%d): %v", n, err)
+        }
+        var stored, lastTMDB int
+        if err := db.QueryRow("SELECT COUNT(*), MAX(tmdb_id) FROM watched WHERE user_id = 1").Scan(&stored, &lastTMDB); err != nil {
+            t.Fatal(err)
+        }
+        if count != n || stored != n || lastTMDB != n {
+            t.Errorf("importEntries(%d) = %d, stored %d rows up to tmdb_id %d", n, count, stored, lastTMDB)
+        }
+
+        // A second import skips everything already in the list
+        if count, err := importEntries(1, importTestEntries(n)); err != nil || count != 0 {
+            t.Errorf("importEntries(%d) again = %d, %v, want 0", n, count, err)
+        }
+    }
+}
+
+func TestImportEntriesMediaType(t *testing.T) {
+    openTestDB(t)
+    if _, err := importEntries(1, []exportEntry{{Title: "Дюна", MediaType: "movie", TMDBID: 7}}); err != nil {
+        t.Fatal(err)
+    }
+    // Movie and TV ids overlap, a series with the same id is a new entry
+    count, err := importEntries(1, []exportEntry{
+        {Title: "Дюна", MediaType: "фильм", TMDBID: 7},
+        {Title: "Дюна: Пророчество", MediaType: "сериал", TMDBID: 7},
+    })
+    if err != nil || count != 1 {
+        t.Errorf("importEntries = %d, %v, want 1", count, err)
+    }
+}
+
+func TestExportImportSeasons(t *testing.T) {
+    openTestDB(t)
+    addTestEntries(t, "Lost")
+    for season, episode := range map[int]int{1: 24, 2: 8} {
+        if _, err := db.Exec("INSERT INTO season_progress (user_id, tmdb_id, season, last_episode) VALUES (1, 1, ?, ?)", season, episode); err != nil {
+            t.Fatal(err)
+        }
+    }
+    entries, err := loadEntries(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    progress, err := allSeasonProgress(1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    export := exportEntries(entries, progress)
+    if len(export) != 1 || export[0].Season != 2 {
+        t.Fatalf("exportEntries = %+v, want season 2", export)
+    }
+
+    csvData, err := exportCSV(export)
+    if err != nil {
+        t.Fatal(err)
+    }
+    jsonData, err := json.Marshal(export)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i, file := range []struct{ name string; data []byte }{{"watched.csv", csvData}, {"watched.json", jsonData}} {
+        userID := int64(i + 2)
+        parsed, _, err := parseImport(file.name, file.data)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := importEntries(userID, parsed); err != nil {
+            t.Fatal(err)
+        }
+        got, err := allSeasonProgress(userID)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(got[1]) != 2 || got[1][1] != 24 || got[1][2] != 8 {
+            t.Errorf("%s: season progress after import = %v, want map[1:24 2:8]", file.name, got[1])
+        }
+    }
+}
+
+// benchmarkInsertWatchedRows inserts 1000 rows per iteration, batchSize
+// rows per statement, in one transaction
+func benchmarkInsertWatchedRows(b *testing.B, batchSize int) {
+    var err error
+    db, err = openStore("sqlite3", filepath.Join(b.TempDir(), "bench.db"))
+    if err != nil {
+        b.Fatal(err)
+    }
+    defer db.Close()
+    log.SetOutput(io.Discard)
+    defer log.SetOutput(os.Stderr)
+    if err := createTables(db); err != nil {
+        b.Fatal(err)
+    }
+
+    var rows []interface{}
+    for _, e := range importTestEntries(1000) {
+        rows = append(rows, e.Title, e.MediaType, e.TMDBID, int64(1), time.Now(), 0, 0, "", 0, e.Rating, "")
+    }
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        tx, err := db.Begin()
+        if err != nil {
+            b.Fatal(err)
+        }
+        if err := insertWatchedRows(tx, rows, batchSize); err != nil {
+            b.Fatal(err)
+        }
+        if err := tx.Commit(); err != nil {
+            b.Fatal(err)
+        }
+    }
+}
+
+func BenchmarkImportSingleRow(b *testing.B) { benchmarkInsertWatchedRows(b, 1) }
+
+func BenchmarkImportBatched(b *testing.B) { benchmarkInsertWatchedRows(b, importBatchSize) }
+
+func TestSplitAddRating(t *testing.T) {
+    tests := []struct {
+        query, title string
+        rating       int
+        ok           bool
+    }{
+        {"Дюна 8", "Дюна", 8, true},
+        {"Ocean's 11 9", "Ocean's 11", 9, true},
+        {"  Во все   тяжкие 10 ", "Во все тяжкие", 10, true},
+        {"Toy Story 3", "Toy Story", 3, true},
+        {"1917", "", 0, false},
+        {"Area 51", "", 0, false},
+        {"Дюна 0", "", 0, false},
+        {"Дюна -5", "", 0, false},
+        {"Дюна", "", 0, false},
+        {"", "", 0, false},
+    }
+    for _, tt := range tests {
+        title, rating, ok := splitAddRating(tt.query)
+        if ok != tt.ok || title != tt.title || rating != tt.rating {
+            t.Errorf("splitAddRating(%q) = %q, %d, %v, want %q, %d, %v", tt.query, title, rating, ok, tt.title, tt.rating, tt.ok)
+        }
+    }
+}
+
+func TestTitleEndsWithNumber(t *testing.T) {
+    tests := []struct {
+        name    string
+        results []TMDBResult
+        n       int
+        want    bool
+    }{
+        {"sequel", []TMDBResult{{Title: "Toy Story 3", MediaType: "movie"}}, 3, true},
+        {"original title", []TMDBResult{{Title: "Одиннадцать друзей Оушена", OriginalTitle: "Ocean's 11", MediaType: "movie"}}, 11, true},
+        {"series name", []TMDBResult{{Name: "Area 51", MediaType: "tv"}}, 51, true},
+        {"original name", []TMDBResult{{Name: "Зона 51", OriginalName: "Area 51", MediaType: "tv"}}, 51, true},
+        {"rating", []TMDBResult{{Title: "Дюна", OriginalTitle: "Dune", MediaType: "movie"}}, 8, false},
+        {"number inside a word", []TMDBResult{{Title: "Apollo 13", MediaType: "movie"}}, 3, false},
+        {"title is the number", []TMDBResult{{Title: "1917", MediaType: "movie"}}, 1917, false},
+        {"only the best result", []TMDBResult{{Title: "Дюна", MediaType: "movie"}, {Title: "Дюна 2", MediaType: "movie"}}, 2, false},
+        {"no results", nil, 8, false},
+    }
+    for _, tt := range tests {
+        if got := titleEndsWithNumber(tt.results, tt.n); got != tt.want {
+            t.Errorf("%s: titleEndsWithNumber(%d) = %v, want %v", tt.name, tt.n, got, tt.want)
+        }
+    }
+}
+
+func TestFormatDay(t *testing.T) {
+    day := time.Date(2024, time.March, 7, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        language, want string
+    }{
+        {"ru", "7 марта, четверг"},
+        {"", "7 марта, четверг"},
+        {"uk", "7 березня, четвер"},
+        {"en", "Thursday, March 7"},
+        {"en-US", "Thursday, March 7"},
+        {"pt-br", "7 марта, четверг"},
+    }
+    for _, tt := range tests {
+        if got := namesFor(tt.language).formatDay(day); got != tt.want {
+            t.Errorf("formatDay for %q = %q, want %q", tt.language, got, tt.want)
+        }
+    }
+}